@@ -28,8 +28,19 @@
 package btrfs // import "blichmann.eu/code/btrfscue/btrfs"
 
 import (
-	"blichmann.eu/code/btrfscue/uuid"
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
 	"time"
+
+	"github.com/klauspost/compress/zstd"
+
+	"blichmann.eu/code/btrfscue/btrfs/csum"
+	"blichmann.eu/code/btrfscue/uuid"
 )
 
 const (
@@ -260,6 +271,20 @@ func (h *Header) IsLeaf() bool {
 	return h.Level == 0
 }
 
+// VerifyCSum reports whether raw, the full serialized node as read from
+// disk (including the CSumSize-byte CSum field itself), checksums to h.CSum
+// under algo.
+func (h *Header) VerifyCSum(raw []byte, algo csum.Algo) bool {
+	if len(raw) < CSumSize {
+		return false
+	}
+	v, err := csum.New(algo)
+	if err != nil {
+		return false
+	}
+	return v.Verify(raw[CSumSize:], h.CSum[:])
+}
+
 type Key struct {
 	ObjectId uint64
 	Type     uint8
@@ -295,6 +320,8 @@ func (i *Item) ParseData(b *ParseBuffer) {
 		i.Data = &InodeItem{}
 	case InodeRefKey:
 		i.Data = &InodeRefItem{}
+	case InodeExtrefKey:
+		i.Data = &InodeExtrefItem{}
 	case XAttrItemKey:
 		fallthrough
 	case DirItemKey:
@@ -302,9 +329,9 @@ func (i *Item) ParseData(b *ParseBuffer) {
 	case DirIndexKey:
 		i.Data = &DirItem{}
 	case ExtentDataKey:
-		i.Data = &FileExtentItem{}
+		i.Data = &FileExtentItem{itemSize: int(i.Size)}
 	case ExtentCSumKey:
-		i.Data = &CSumItem{}
+		i.Data = &CSumItem{numBytes: int(i.Size)}
 	case RootItemKey:
 		i.Data = &RootItem{}
 	case RootBackRefKey:
@@ -315,6 +342,51 @@ func (i *Item) ParseData(b *ParseBuffer) {
 		i.Data = &ExtentItem{}
 	case BlockGroupItemKey:
 		i.Data = &BlockGroupItem{}
+	case OrphanItemKey:
+		// No item payload; the orphaned objectid is Key.ObjectId itself.
+		return
+	case DirLogItemKey:
+		i.Data = &DirLogItem{}
+	case TreeBlockRefKey:
+		fallthrough
+	case SharedBlockRefKey:
+		// No item payload; the referencing root (TreeBlockRefKey) or parent
+		// bytenr (SharedBlockRefKey) is encoded in Key.Offset.
+		return
+	case ExtentDataRefKey:
+		i.Data = &ExtentDataRefItem{}
+	case SharedDataRefKey:
+		i.Data = &SharedDataRefItem{}
+	case FreeSpaceInfoKey:
+		i.Data = &FreeSpaceInfo{}
+	case FreeSpaceExtentKey:
+		// No item payload; start and length are encoded in Key.ObjectId and
+		// Key.Offset.
+		return
+	case FreeSpaceBitmapKey:
+		i.Data = &FreeSpaceBitmap{numBytes: int(i.Size)}
+	case DevExtentKey:
+		i.Data = &DevExtent{}
+	case DevItemKey:
+		i.Data = &DevItem{}
+	case ChunkItemKey:
+		i.Data = &ChunkItem{}
+	case QgroupStatusKey:
+		i.Data = &QgroupStatusItem{}
+	case QgroupInfoKey:
+		i.Data = &QgroupInfoItem{}
+	case QgroupLimitKey:
+		i.Data = &QgroupLimitItem{}
+	case QgroupRelationKey:
+		// No item payload; both ends of the relation are encoded in the key,
+		// see the comment on QgroupRelationKey.
+		return
+	case BalanceItemKey:
+		i.Data = &BalanceItem{}
+	case DevStatsKey:
+		i.Data = &DevStatsItem{}
+	case DevReplaceKey:
+		i.Data = &DevReplaceItem{}
 	default:
 		return
 	}
@@ -384,6 +456,30 @@ func (i *InodeRefItem) Parse(b *ParseBuffer) {
 	i.Name = string(b.Next(l))
 }
 
+// InodeExtrefItem is an extended inode reference, used once an inode has
+// enough hardlinks that their names no longer fit in InodeRefItem entries.
+// It is keyed on (inode_objectid, InodeExtrefKey, name_hash), so several may
+// share the same parent directory. Path reconstruction must consult both
+// InodeRefItem and InodeExtrefItem to find all names of a heavily-linked
+// inode.
+type InodeExtrefItem struct {
+	ParentObjectId uint64
+	Index          uint64
+	NameLen        uint16
+	Name           string
+}
+
+func (i *InodeExtrefItem) Parse(b *ParseBuffer) {
+	i.ParentObjectId = b.NextUint64()
+	i.Index = b.NextUint64()
+	i.NameLen = b.NextUint16()
+	l := int(i.NameLen)
+	if l > 255 {
+		l = 255
+	}
+	i.Name = string(b.Next(l))
+}
+
 type DirItem struct {
 	Location Key
 	TransId  uint64
@@ -412,6 +508,22 @@ func (i *DirItem) Parse(b *ParseBuffer) {
 	i.Data = string(b.Next(l))
 }
 
+// Block group profile flags, found in both BlockGroupItem.Flags and
+// ChunkItem.Type. The low three bits classify the block group's contents
+// (data/system/metadata); the rest select the replication/striping profile.
+const (
+	BlockGroupData     = 1 << 0
+	BlockGroupSystem   = 1 << 1
+	BlockGroupMetadata = 1 << 2
+
+	BlockGroupRAID0  = 1 << 3
+	BlockGroupRAID1  = 1 << 4
+	BlockGroupDUP    = 1 << 5
+	BlockGroupRAID10 = 1 << 6
+	BlockGroupRAID5  = 1 << 7
+	BlockGroupRAID6  = 1 << 8
+)
+
 type BlockGroupItem struct {
 	Used          uint64
 	ChunkObjectId uint64
@@ -424,6 +536,25 @@ func (i *BlockGroupItem) Parse(b *ParseBuffer) {
 	i.Flags = b.NextUint64()
 }
 
+// File extent types, stored in FileExtentItem.Type
+const (
+	// The extent data is inlined right after the item header, there is no
+	// separate extent on disk
+	FileExtentInline = 0
+	// The regular case: a real extent on disk
+	FileExtentReg = 1
+	// Preallocated extent that has not been written to yet
+	FileExtentPreAlloc = 2
+)
+
+// Compression algorithms, stored in FileExtentItem.Compression
+const (
+	CompressionNone = 0
+	CompressionZlib = 1
+	CompressionLZO  = 2
+	CompressionZstd = 3
+)
+
 type FileExtentItem struct {
 	// Transaction id that created this extent
 	Generation uint64
@@ -431,7 +562,8 @@ type FileExtentItem struct {
 	// Max number of bytes to hold this extent in ram when we split a
 	// compressed extent we can't know how big each of the resulting pieces
 	// will be. So, this is an upper limit on the size of the extent in ram
-	// instead of an exact limit.
+	// instead of an exact limit. For inline extents, this is the
+	// authoritative uncompressed length of the data.
 	RamBytes uint64
 
 	// 32 bits for the various ways we might encode the data, including
@@ -461,8 +593,21 @@ type FileExtentItem struct {
 	// The logical number of file blocks (no csums included). This always
 	// reflects the size uncompressed and without encoding.
 	NumBytes uint64
+
+	// InlineData holds the raw, possibly compressed, file payload when
+	// Type == FileExtentInline. Use Decompress to get at the actual file
+	// contents.
+	InlineData []byte
+
+	// Size of the item as recorded by Item.Size, needed to bound InlineData
+	// since it has no length field of its own.
+	itemSize int
 }
 
+// fileExtentHeaderSize is the number of bytes Parse consumes before reaching
+// either the disk-extent fields or, for inline extents, the extent data.
+const fileExtentHeaderSize = 8 + 8 + 1 + 1 + 2 + 1
+
 func (i *FileExtentItem) Parse(b *ParseBuffer) {
 	i.Generation = b.NextUint64()
 	i.RamBytes = b.NextUint64()
@@ -470,20 +615,60 @@ func (i *FileExtentItem) Parse(b *ParseBuffer) {
 	i.Encryption = b.NextUint8()
 	i.OtherEncoding = b.NextUint16()
 	i.Type = b.NextUint8()
-	// TODO(cblichmann): Inline extents
+	if i.Type == FileExtentInline {
+		n := i.itemSize - fileExtentHeaderSize
+		if n < 0 {
+			n = 0
+		}
+		i.InlineData = b.Next(n)
+		return
+	}
 	i.DiskByteNr = b.NextUint64()
 	i.DiskNumBytes = b.NextUint64()
 	i.Offset = b.NextUint64()
 	i.NumBytes = b.NextUint64()
 }
 
+// Decompress returns the decompressed contents of InlineData according to
+// Compression. It is only meaningful when Type == FileExtentInline.
+func (i *FileExtentItem) Decompress() ([]byte, error) {
+	switch i.Compression {
+	case CompressionNone:
+		return i.InlineData, nil
+	case CompressionZlib:
+		r, err := zlib.NewReader(bytes.NewReader(i.InlineData))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return ioutil.ReadAll(r)
+	case CompressionZstd:
+		r, err := zstd.NewReader(bytes.NewReader(i.InlineData))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return ioutil.ReadAll(r)
+	case CompressionLZO:
+		return nil, errors.New("btrfs: LZO decompression not supported")
+	}
+	return nil, fmt.Errorf("btrfs: unknown compression type %d", i.Compression)
+}
+
+// CSumItem holds a sequence of checksums covering a contiguous run of data
+// extents in the csum tree, one checksum per sector. Splitting CSum into
+// the individual, per-sector checksums requires knowing the filesystem's
+// checksum algorithm, see the btrfs/csum package.
 type CSumItem struct {
-	CSum uint8
+	CSum []byte
+
+	// Size of the item as recorded by Item.Size; CSumItem has no length
+	// field of its own.
+	numBytes int
 }
 
 func (i *CSumItem) Parse(b *ParseBuffer) {
-	i.CSum = b.NextUint8()
-	// TODO(cblichmann): Parse the actual checksums
+	i.CSum = b.Next(i.numBytes)
 }
 
 type RootItem struct {
@@ -580,11 +765,614 @@ func (i *ExtentItem) Parse(b *ParseBuffer) {
 	i.Flags = b.NextUint64()
 }
 
+// DirLogItem records how far a directory log tree has been replayed.
+type DirLogItem struct {
+	End uint64
+}
+
+func (i *DirLogItem) Parse(b *ParseBuffer) {
+	i.End = b.NextUint64()
+}
+
+// ExtentDataRefItem is a back reference from a data extent to the inode and
+// file extent item that refer to it.
+type ExtentDataRefItem struct {
+	Root     uint64
+	ObjectId uint64
+	Offset   uint64
+	Count    uint32
+}
+
+func (i *ExtentDataRefItem) Parse(b *ParseBuffer) {
+	i.Root = b.NextUint64()
+	i.ObjectId = b.NextUint64()
+	i.Offset = b.NextUint64()
+	i.Count = b.NextUint32()
+}
+
+// SharedDataRefItem counts how many times a data extent is referenced from
+// the same shared subtree.
+type SharedDataRefItem struct {
+	Count uint32
+}
+
+func (i *SharedDataRefItem) Parse(b *ParseBuffer) {
+	i.Count = b.NextUint32()
+}
+
+// FreeSpaceUsingBitmaps is set in FreeSpaceInfo.Flags when a block group has
+// become fragmented enough that its free space is tracked with
+// FreeSpaceBitmapKey items rather than FreeSpaceExtentKey items.
+const FreeSpaceUsingBitmaps = 1 << 0
+
+// FreeSpaceInfo stores accounting information for a block group's free space
+// tree representation. It is keyed on (block_group_start, FreeSpaceInfoKey,
+// block_group_length).
+type FreeSpaceInfo struct {
+	ExtentCount uint32
+	Flags       uint32
+}
+
+func (i *FreeSpaceInfo) Parse(b *ParseBuffer) {
+	i.ExtentCount = b.NextUint32()
+	i.Flags = b.NextUint32()
+}
+
+// FreeSpaceBitmap is a bitmap of free sectors for a block group that has
+// become too fragmented to track as individual extents. Bit i corresponds
+// to sector start+i*sectorsize, where start is the FreeSpaceBitmapKey's
+// Key.ObjectId.
+type FreeSpaceBitmap struct {
+	Bits []byte
+
+	// Size of the item as recorded by Item.Size; the bitmap has no length
+	// field of its own.
+	numBytes int
+}
+
+func (i *FreeSpaceBitmap) Parse(b *ParseBuffer) {
+	i.Bits = b.Next(i.numBytes)
+}
+
+// DevExtent records that a range of a device belongs to a chunk. One lives
+// in the device tree for every stripe of every chunk.
+type DevExtent struct {
+	ChunkTree     uint64
+	ChunkObjectId uint64
+	ChunkOffset   uint64
+	Length        uint64
+	ChunkTreeUUID uuid.UUID
+}
+
+func (i *DevExtent) Parse(b *ParseBuffer) {
+	i.ChunkTree = b.NextUint64()
+	i.ChunkObjectId = b.NextUint64()
+	i.ChunkOffset = b.NextUint64()
+	i.Length = b.NextUint64()
+	copy(i.ChunkTreeUUID[:], b.Next(uuid.UUIDSize))
+}
+
+// DevItem describes a single device that is part of this filesystem. One
+// lives in the chunk tree for every device.
+type DevItem struct {
+	// The internal btrfs device id
+	DevId uint64
+
+	// Size of the device
+	TotalBytes uint64
+	// Bytes used
+	BytesUsed uint64
+
+	// Optimal io alignment for this device
+	IoAlign uint32
+	// Optimal io width for this device
+	IoWidth uint32
+	// Minimal io size for this device
+	SectorSize uint32
+
+	// Type and info about this device
+	Type uint64
+	// Expected generation for this device
+	Generation uint64
+	// Starting byte of this partition on the device, to allow for stripe
+	// alignment in the future
+	StartOffset uint64
+	// Grouping information for allocation decisions
+	DevGroup uint32
+	// Seek speed 0-100 where 100 is fastest
+	SeekSpeed uint8
+	// Bandwidth 0-100 where 100 is fastest
+	Bandwidth uint8
+
+	// Btrfs generated uuid for this device
+	UUID uuid.UUID
+	// UUID of the FS that owns this device
+	FSID uuid.UUID
+}
+
+func (i *DevItem) Parse(b *ParseBuffer) {
+	i.DevId = b.NextUint64()
+	i.TotalBytes = b.NextUint64()
+	i.BytesUsed = b.NextUint64()
+	i.IoAlign = b.NextUint32()
+	i.IoWidth = b.NextUint32()
+	i.SectorSize = b.NextUint32()
+	i.Type = b.NextUint64()
+	i.Generation = b.NextUint64()
+	i.StartOffset = b.NextUint64()
+	i.DevGroup = b.NextUint32()
+	i.SeekSpeed = b.NextUint8()
+	i.Bandwidth = b.NextUint8()
+	copy(i.UUID[:], b.Next(uuid.UUIDSize))
+	copy(i.FSID[:], b.Next(uuid.UUIDSize))
+}
+
+// ChunkItem maps a logical chunk to one or more physical stripes on the
+// underlying device(s).
+type ChunkItem struct {
+	// Size of this chunk in bytes
+	Length uint64
+	// Objectid of the root referencing this chunk
+	Owner     uint64
+	StripeLen uint64
+	Type      uint64
+
+	// Optimal io alignment for this chunk
+	IoAlign uint32
+	// Optimal io width for this chunk
+	IoWidth uint32
+	// Minimal io size for this chunk
+	SectorSize uint32
+	// Number of stripes
+	NumStripes uint16
+	// Sub stripes are used for raid10
+	SubStripes uint16
+
+	Stripes []Stripe
+}
+
+func (i *ChunkItem) Parse(b *ParseBuffer) {
+	i.Length = b.NextUint64()
+	i.Owner = b.NextUint64()
+	i.StripeLen = b.NextUint64()
+	i.Type = b.NextUint64()
+	i.IoAlign = b.NextUint32()
+	i.IoWidth = b.NextUint32()
+	i.SectorSize = b.NextUint32()
+	i.NumStripes = b.NextUint16()
+	i.SubStripes = b.NextUint16()
+	i.Stripes = make([]Stripe, i.NumStripes)
+	for j, _ := range i.Stripes {
+		i.Stripes[j].Parse(b)
+	}
+}
+
+// Stripe is one physical copy of a chunk, identified by the device it lives
+// on and the byte offset into that device.
+type Stripe struct {
+	DevId   uint64
+	Offset  uint64
+	DevUUID uuid.UUID
+}
+
+func (s *Stripe) Parse(b *ParseBuffer) {
+	s.DevId = b.NextUint64()
+	s.Offset = b.NextUint64()
+	copy(s.DevUUID[:], b.Next(uuid.UUIDSize))
+}
+
+// QgroupStatusItem records the overall state of the qgroup subsystem. There
+// is only one instance of this item, keyed on (0, QgroupStatusKey, 0).
+type QgroupStatusItem struct {
+	Version    uint64
+	Generation uint64
+	Flags      uint64
+	// Objectid of the tree currently being rescanned, if any
+	Rescan uint64
+}
+
+func (i *QgroupStatusItem) Parse(b *ParseBuffer) {
+	i.Version = b.NextUint64()
+	i.Generation = b.NextUint64()
+	i.Flags = b.NextUint64()
+	i.Rescan = b.NextUint64()
+}
+
+// QgroupInfoItem records the currently used space of a qgroup. One lives
+// per qgroup, keyed on (0, QgroupInfoKey, qgroupid).
+type QgroupInfoItem struct {
+	Generation           uint64
+	Referenced           uint64
+	ReferencedCompressed uint64
+	Exclusive            uint64
+	ExclusiveCompressed  uint64
+}
+
+func (i *QgroupInfoItem) Parse(b *ParseBuffer) {
+	i.Generation = b.NextUint64()
+	i.Referenced = b.NextUint64()
+	i.ReferencedCompressed = b.NextUint64()
+	i.Exclusive = b.NextUint64()
+	i.ExclusiveCompressed = b.NextUint64()
+}
+
+// QgroupLimitItem holds the user configured limits for a qgroup. One lives
+// per qgroup, keyed on (0, QgroupLimitKey, qgroupid).
+type QgroupLimitItem struct {
+	Flags         uint64
+	MaxReferenced uint64
+	MaxExclusive  uint64
+	RsvReferenced uint64
+	RsvExclusive  uint64
+}
+
+func (i *QgroupLimitItem) Parse(b *ParseBuffer) {
+	i.Flags = b.NextUint64()
+	i.MaxReferenced = b.NextUint64()
+	i.MaxExclusive = b.NextUint64()
+	i.RsvReferenced = b.NextUint64()
+	i.RsvExclusive = b.NextUint64()
+}
+
+// BalanceArgs describes the filter and target profile used for one of the
+// three block group types (data, metadata, system) during a balance.
+type BalanceArgs struct {
+	Profiles uint64
+	Usage    uint64
+	DevId    uint64
+	PStart   uint64
+	PEnd     uint64
+	VStart   uint64
+	VEnd     uint64
+	Target   uint64
+	Flags    uint64
+
+	LimitMin uint32
+	LimitMax uint32
+
+	StripesMin uint32
+	StripesMax uint32
+
+	Reserved [6]uint64
+}
+
+func (a *BalanceArgs) Parse(b *ParseBuffer) {
+	a.Profiles = b.NextUint64()
+	a.Usage = b.NextUint64()
+	a.DevId = b.NextUint64()
+	a.PStart = b.NextUint64()
+	a.PEnd = b.NextUint64()
+	a.VStart = b.NextUint64()
+	a.VEnd = b.NextUint64()
+	a.Target = b.NextUint64()
+	a.Flags = b.NextUint64()
+	a.LimitMin = b.NextUint32()
+	a.LimitMax = b.NextUint32()
+	a.StripesMin = b.NextUint32()
+	a.StripesMax = b.NextUint32()
+	for j, _ := range a.Reserved {
+		a.Reserved[j] = b.NextUint64()
+	}
+}
+
+// BalanceItem stores the state of a running or paused balance operation.
+type BalanceItem struct {
+	Flags uint64
+
+	Data BalanceArgs
+	Meta BalanceArgs
+	Sys  BalanceArgs
+
+	Unused [4]uint64
+}
+
+func (i *BalanceItem) Parse(b *ParseBuffer) {
+	i.Flags = b.NextUint64()
+	i.Data.Parse(b)
+	i.Meta.Parse(b)
+	i.Sys.Parse(b)
+	for j, _ := range i.Unused {
+		i.Unused[j] = b.NextUint64()
+	}
+}
+
+// DevStatsItem persistently stores the io stats of a single device. One
+// lives in the device tree for every device, keyed on (0, DevStatsKey,
+// devid).
+type DevStatsItem struct {
+	WriteErrs      uint64
+	ReadErrs       uint64
+	FlushErrs      uint64
+	CorruptionErrs uint64
+	GenerationErrs uint64
+}
+
+func (i *DevStatsItem) Parse(b *ParseBuffer) {
+	i.WriteErrs = b.NextUint64()
+	i.ReadErrs = b.NextUint64()
+	i.FlushErrs = b.NextUint64()
+	i.CorruptionErrs = b.NextUint64()
+	i.GenerationErrs = b.NextUint64()
+}
+
+// DevReplaceItem persistently stores the device replace state in the device
+// tree. The key is built like this: (0, DevReplaceKey, 0).
+type DevReplaceItem struct {
+	SrcDevId                   uint64
+	CursorLeft                 uint64
+	CursorRight                uint64
+	ContReadingFromSrcDevMode  uint64
+	ReplaceState               uint64
+	TimeStarted                uint64
+	TimeStopped                uint64
+	NumWriteErrors             uint64
+	NumUncorrectableReadErrors uint64
+}
+
+func (i *DevReplaceItem) Parse(b *ParseBuffer) {
+	i.SrcDevId = b.NextUint64()
+	i.CursorLeft = b.NextUint64()
+	i.CursorRight = b.NextUint64()
+	i.ContReadingFromSrcDevMode = b.NextUint64()
+	i.ReplaceState = b.NextUint64()
+	i.TimeStarted = b.NextUint64()
+	i.TimeStopped = b.NextUint64()
+	i.NumWriteErrors = b.NextUint64()
+	i.NumUncorrectableReadErrors = b.NextUint64()
+}
+
+// SuperInfoSize is the on-disk size of a single superblock copy.
+const SuperInfoSize = 4096
+
+// NumBackupRoots is the number of backup root copies stored in each
+// superblock.
+const NumBackupRoots = 4
+
+// RootBackup is a point-in-time snapshot of the location of every tree root,
+// kept so that a filesystem can still be mounted if its root tree is lost.
+type RootBackup struct {
+	TreeRoot      uint64
+	TreeRootGen   uint64
+	ChunkRoot     uint64
+	ChunkRootGen  uint64
+	ExtentRoot    uint64
+	ExtentRootGen uint64
+	FSRoot        uint64
+	FSRootGen     uint64
+	DevRoot       uint64
+	DevRootGen    uint64
+	CSumRoot      uint64
+	CSumRootGen   uint64
+	TotalBytes    uint64
+	BytesUsed     uint64
+	NumDevices    uint64
+	Unused        [4]uint64
+
+	TreeRootLevel   uint8
+	ChunkRootLevel  uint8
+	ExtentRootLevel uint8
+	FSRootLevel     uint8
+	DevRootLevel    uint8
+	CSumRootLevel   uint8
+}
+
+func (r *RootBackup) Parse(b *ParseBuffer) {
+	r.TreeRoot = b.NextUint64()
+	r.TreeRootGen = b.NextUint64()
+	r.ChunkRoot = b.NextUint64()
+	r.ChunkRootGen = b.NextUint64()
+	r.ExtentRoot = b.NextUint64()
+	r.ExtentRootGen = b.NextUint64()
+	r.FSRoot = b.NextUint64()
+	r.FSRootGen = b.NextUint64()
+	r.DevRoot = b.NextUint64()
+	r.DevRootGen = b.NextUint64()
+	r.CSumRoot = b.NextUint64()
+	r.CSumRootGen = b.NextUint64()
+	r.TotalBytes = b.NextUint64()
+	r.BytesUsed = b.NextUint64()
+	r.NumDevices = b.NextUint64()
+	for i, _ := range r.Unused {
+		r.Unused[i] = b.NextUint64()
+	}
+	r.TreeRootLevel = b.NextUint8()
+	r.ChunkRootLevel = b.NextUint8()
+	r.ExtentRootLevel = b.NextUint8()
+	r.FSRootLevel = b.NextUint8()
+	r.DevRootLevel = b.NextUint8()
+	r.CSumRootLevel = b.NextUint8()
+	// Trailing reserved padding (unused_8)
+	b.Next(10)
+}
+
+// SuperBlock is the root of all metadata in a btrfs filesystem. Up to four
+// copies are kept, at SuperInfoOffset, SuperInfoOffset2, SuperInfoOffset3
+// and SuperInfoOffset4; see ReadAllSuperBlocks.
+type SuperBlock struct {
+	CSum CSum
+	FSID uuid.UUID
+
+	// The start of this block relative to the beginning of the backing
+	// device
+	ByteNr uint64
+	Flags  uint64
+	Magic  uint64
+
+	Generation uint64
+
+	// Logical address of the root tree root
+	Root uint64
+	// Logical address of the chunk tree root
+	ChunkRoot uint64
+	// Logical address of the log tree root
+	LogRoot uint64
+	// Transid of the log root when it was last committed
+	LogRootTransid uint64
+
+	TotalBytes uint64
+	BytesUsed  uint64
+
+	RootDirObjectId uint64
+	NumDevices      uint64
+
+	SectorSize uint32
+	NodeSize   uint32
+	StripeSize uint32
+
+	SysChunkArraySize uint32
+
+	ChunkRootGeneration uint64
+
+	CompatFlags   uint64
+	CompatROFlags uint64
+	IncompatFlags uint64
+
+	// Checksum algorithm used for this filesystem, see btrfs/csum
+	CSumType csum.Algo
+
+	RootLevel      uint8
+	ChunkRootLevel uint8
+	LogRootLevel   uint8
+
+	DevItem DevItem
+
+	Label string
+
+	CacheGeneration    uint64
+	UUIDTreeGeneration uint64
+
+	// Holds the chunk items needed to bootstrap the chunk tree: the chunks
+	// that contain the chunk tree root itself, see chunktree.Resolver.
+	SysChunkArray [SystemChunkArraySize]byte
+
+	RootBackups [NumBackupRoots]RootBackup
+}
+
+// superBlockReservedSize is the size in bytes of the reserved field between
+// UUIDTreeGeneration and SysChunkArray, set aside for future expansion.
+const superBlockReservedSize = 30 * 8
+
+func (s *SuperBlock) Parse(b *ParseBuffer) {
+	copy(s.CSum[:], b.Next(CSumSize))
+	copy(s.FSID[:], b.Next(uuid.UUIDSize))
+	s.ByteNr = b.NextUint64()
+	s.Flags = b.NextUint64()
+	s.Magic = b.NextUint64()
+	s.Generation = b.NextUint64()
+	s.Root = b.NextUint64()
+	s.ChunkRoot = b.NextUint64()
+	s.LogRoot = b.NextUint64()
+	s.LogRootTransid = b.NextUint64()
+	s.TotalBytes = b.NextUint64()
+	s.BytesUsed = b.NextUint64()
+	s.RootDirObjectId = b.NextUint64()
+	s.NumDevices = b.NextUint64()
+	s.SectorSize = b.NextUint32()
+	s.NodeSize = b.NextUint32()
+	// Historically leafsize, always equal to NodeSize; unused since kernel
+	// 4.x but still present in the on-disk layout.
+	b.Next(4)
+	s.StripeSize = b.NextUint32()
+	s.SysChunkArraySize = b.NextUint32()
+	s.ChunkRootGeneration = b.NextUint64()
+	s.CompatFlags = b.NextUint64()
+	s.CompatROFlags = b.NextUint64()
+	s.IncompatFlags = b.NextUint64()
+	s.CSumType = csum.Algo(b.NextUint16())
+	s.RootLevel = b.NextUint8()
+	s.ChunkRootLevel = b.NextUint8()
+	s.LogRootLevel = b.NextUint8()
+	s.DevItem.Parse(b)
+	label := b.Next(LabelSize)
+	if i := bytes.IndexByte(label, 0); i >= 0 {
+		label = label[:i]
+	}
+	s.Label = string(label)
+	s.CacheGeneration = b.NextUint64()
+	s.UUIDTreeGeneration = b.NextUint64()
+	// Reserved for future expansion
+	b.Next(superBlockReservedSize)
+	copy(s.SysChunkArray[:], b.Next(SystemChunkArraySize))
+	for i, _ := range s.RootBackups {
+		s.RootBackups[i].Parse(b)
+	}
+}
+
+// IsValid reports whether s looks like a genuine superblock, i.e. whether
+// its magic number matches. It does not verify the checksum, use
+// ReadAllSuperBlocks or VerifyCSum for that.
+func (s *SuperBlock) IsValid() bool {
+	return s.Magic == Magic
+}
+
+// VerifyCSum reports whether raw, the full SuperInfoSize-long serialized
+// superblock as read from disk (including the CSumSize-byte CSum field
+// itself), checksums to s.CSum under s.CSumType.
+func (s *SuperBlock) VerifyCSum(raw []byte) bool {
+	if len(raw) < CSumSize {
+		return false
+	}
+	v, err := csum.New(s.CSumType)
+	if err != nil {
+		return false
+	}
+	return v.Verify(raw[CSumSize:], s.CSum[:])
+}
+
+// ReadAllSuperBlocks reads every superblock copy at SuperInfoOffset,
+// SuperInfoOffset2, SuperInfoOffset3 and SuperInfoOffset4 that is present
+// (i.e. doesn't read past the end of r) and valid (magic matches and its
+// checksum verifies). The result is sorted by ascending Generation, so the
+// last entry is the authoritative copy. It is an error if no copy at all
+// passes validation.
+func ReadAllSuperBlocks(r io.ReaderAt) ([]SuperBlock, error) {
+	offsets := []int64{
+		SuperInfoOffset, SuperInfoOffset2, SuperInfoOffset3, SuperInfoOffset4,
+	}
+	var sbs []SuperBlock
+	for _, offset := range offsets {
+		raw := make([]byte, SuperInfoSize)
+		if _, err := r.ReadAt(raw, offset); err != nil {
+			if err == io.EOF {
+				continue
+			}
+			return nil, err
+		}
+		var sb SuperBlock
+		sb.Parse(NewParseBuffer(raw))
+		if !sb.IsValid() || !sb.VerifyCSum(raw) {
+			continue
+		}
+		sbs = append(sbs, sb)
+	}
+	if len(sbs) == 0 {
+		return nil, errors.New("btrfs: no valid super block found")
+	}
+	sort.Slice(sbs, func(i, j int) bool { return sbs[i].Generation < sbs[j].Generation })
+	return sbs, nil
+}
+
+// ErrCSumMismatch is returned by Leaf.ParseVerified when a leaf's computed
+// checksum does not match the one stored in its header.
+var ErrCSumMismatch = errors.New("btrfs: checksum mismatch")
+
 type Leaf struct {
 	Header
 	Items []Item
 }
 
+// ParseVerified is like Parse, but first checks raw, the full serialized
+// node as read from disk, against l.Header.CSum using algo. l.Header must
+// already have been parsed. If the checksum does not match, it returns
+// ErrCSumMismatch and leaves l.Items untouched.
+func (l *Leaf) ParseVerified(b *ParseBuffer, raw []byte, algo csum.Algo) error {
+	if !l.Header.VerifyCSum(raw, algo) {
+		return ErrCSumMismatch
+	}
+	l.Parse(b)
+	return nil
+}
+
 func (l *Leaf) Parse(b *ParseBuffer) {
 	if l.Header.NrItems == 0 {
 		return
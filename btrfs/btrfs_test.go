@@ -0,0 +1,324 @@
+/*
+ * btrfscue version 0.3
+ * Copyright (c)2011-2016 Christian Blichmann
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package btrfs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+
+	"blichmann.eu/code/btrfscue/btrfs/csum"
+)
+
+func le64(buf *bytes.Buffer, v uint64) { binary.Write(buf, binary.LittleEndian, v) }
+func le32(buf *bytes.Buffer, v uint32) { binary.Write(buf, binary.LittleEndian, v) }
+func le16(buf *bytes.Buffer, v uint16) { binary.Write(buf, binary.LittleEndian, v) }
+func le8(buf *bytes.Buffer, v uint8)   { buf.WriteByte(v) }
+
+func TestDevItemParse(t *testing.T) {
+	var buf bytes.Buffer
+	le64(&buf, 7)                    // DevId
+	le64(&buf, 1<<30)                // TotalBytes
+	le64(&buf, 1<<20)                // BytesUsed
+	le32(&buf, 4096)                 // IoAlign
+	le32(&buf, 4096)                 // IoWidth
+	le32(&buf, 4096)                 // SectorSize
+	le64(&buf, 0)                    // Type
+	le64(&buf, 42)                   // Generation
+	le64(&buf, 0)                    // StartOffset
+	le32(&buf, 0)                    // DevGroup
+	le8(&buf, 0)                     // SeekSpeed
+	le8(&buf, 0)                     // Bandwidth
+	buf.Write(bytes.Repeat([]byte{1}, 16)) // UUID
+	buf.Write(bytes.Repeat([]byte{2}, 16)) // FSID
+
+	var got DevItem
+	got.Parse(NewParseBuffer(buf.Bytes()))
+
+	if got.DevId != 7 || got.TotalBytes != 1<<30 || got.BytesUsed != 1<<20 ||
+		got.SectorSize != 4096 || got.Generation != 42 {
+		t.Fatalf("DevItem.Parse produced unexpected result: %+v", got)
+	}
+	wantUUID := bytes.Repeat([]byte{1}, 16)
+	if !bytes.Equal(got.UUID[:], wantUUID) {
+		t.Errorf("UUID = %x, want %x", got.UUID[:], wantUUID)
+	}
+}
+
+func TestChunkItemParse(t *testing.T) {
+	var buf bytes.Buffer
+	le64(&buf, 1<<24) // Length
+	le64(&buf, 2)     // Owner
+	le64(&buf, 65536) // StripeLen
+	le64(&buf, BlockGroupData|BlockGroupRAID0) // Type
+	le32(&buf, 0)     // IoAlign
+	le32(&buf, 0)     // IoWidth
+	le32(&buf, 4096)  // SectorSize
+	le16(&buf, 2)     // NumStripes
+	le16(&buf, 0)     // SubStripes
+	for i := 0; i < 2; i++ {
+		le64(&buf, uint64(i+1)) // DevId
+		le64(&buf, uint64(i)*1<<20) // Offset
+		buf.Write(make([]byte, 16)) // DevUUID
+	}
+
+	var got ChunkItem
+	got.Parse(NewParseBuffer(buf.Bytes()))
+
+	if got.Length != 1<<24 || got.NumStripes != 2 || len(got.Stripes) != 2 {
+		t.Fatalf("ChunkItem.Parse produced unexpected result: %+v", got)
+	}
+	if got.Stripes[1].DevId != 2 || got.Stripes[1].Offset != 1<<20 {
+		t.Errorf("Stripes[1] = %+v, want DevId=2 Offset=%d", got.Stripes[1], uint64(1<<20))
+	}
+}
+
+func TestQgroupInfoItemParse(t *testing.T) {
+	var buf bytes.Buffer
+	le64(&buf, 1) // Generation
+	le64(&buf, 2) // Referenced
+	le64(&buf, 3) // ReferencedCompressed
+	le64(&buf, 4) // Exclusive
+	le64(&buf, 5) // ExclusiveCompressed
+
+	var got QgroupInfoItem
+	got.Parse(NewParseBuffer(buf.Bytes()))
+
+	want := QgroupInfoItem{1, 2, 3, 4, 5}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("QgroupInfoItem.Parse = %+v, want %+v", got, want)
+	}
+}
+
+func TestItemParseDataFreeSpaceBitmap(t *testing.T) {
+	bits := []byte{0xff, 0x0f}
+	item := Item{Key: Key{Type: FreeSpaceBitmapKey}, Size: uint32(len(bits))}
+	item.ParseData(NewParseBuffer(bits))
+
+	fb, ok := item.Data.(*FreeSpaceBitmap)
+	if !ok {
+		t.Fatalf("Data has type %T, want *FreeSpaceBitmap", item.Data)
+	}
+	if !bytes.Equal(fb.Bits, bits) {
+		t.Errorf("Bits = %x, want %x", fb.Bits, bits)
+	}
+}
+
+func TestItemParseDataNoPayloadTypes(t *testing.T) {
+	for _, keyType := range []uint8{
+		OrphanItemKey, TreeBlockRefKey, SharedBlockRefKey, FreeSpaceExtentKey,
+		QgroupRelationKey,
+	} {
+		item := Item{Key: Key{Type: keyType}}
+		item.ParseData(NewParseBuffer(nil))
+		if item.Data != nil {
+			t.Errorf("key type %d: Data = %+v, want nil", keyType, item.Data)
+		}
+	}
+}
+
+func TestFileExtentItemParseInline(t *testing.T) {
+	payload := []byte("hello, inline world")
+	var buf bytes.Buffer
+	le64(&buf, 1)                 // Generation
+	le64(&buf, uint64(len(payload))) // RamBytes
+	le8(&buf, CompressionNone)     // Compression
+	le8(&buf, 0)                   // Encryption
+	le16(&buf, 0)                  // OtherEncoding
+	le8(&buf, FileExtentInline)    // Type
+	buf.Write(payload)
+
+	item := Item{Key: Key{Type: ExtentDataKey}, Size: uint32(buf.Len())}
+	item.ParseData(NewParseBuffer(buf.Bytes()))
+
+	fe, ok := item.Data.(*FileExtentItem)
+	if !ok {
+		t.Fatalf("Data has type %T, want *FileExtentItem", item.Data)
+	}
+	if fe.Type != FileExtentInline || fe.RamBytes != uint64(len(payload)) {
+		t.Fatalf("unexpected FileExtentItem: %+v", fe)
+	}
+	if !bytes.Equal(fe.InlineData, payload) {
+		t.Errorf("InlineData = %q, want %q", fe.InlineData, payload)
+	}
+	got, err := fe.Decompress()
+	if err != nil {
+		t.Fatalf("Decompress: %v", err)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Errorf("Decompress() = %q, want %q", got, payload)
+	}
+}
+
+func TestFileExtentItemParseRegular(t *testing.T) {
+	var buf bytes.Buffer
+	le64(&buf, 1)                // Generation
+	le64(&buf, 4096)              // RamBytes
+	le8(&buf, CompressionNone)    // Compression
+	le8(&buf, 0)                  // Encryption
+	le16(&buf, 0)                 // OtherEncoding
+	le8(&buf, FileExtentReg)      // Type
+	le64(&buf, 0x100000)          // DiskByteNr
+	le64(&buf, 4096)              // DiskNumBytes
+	le64(&buf, 0)                 // Offset
+	le64(&buf, 4096)              // NumBytes
+
+	item := Item{Key: Key{Type: ExtentDataKey}, Size: uint32(buf.Len())}
+	item.ParseData(NewParseBuffer(buf.Bytes()))
+
+	fe, ok := item.Data.(*FileExtentItem)
+	if !ok {
+		t.Fatalf("Data has type %T, want *FileExtentItem", item.Data)
+	}
+	if fe.Type != FileExtentReg || fe.DiskByteNr != 0x100000 || fe.NumBytes != 4096 {
+		t.Fatalf("unexpected FileExtentItem: %+v", fe)
+	}
+	if fe.InlineData != nil {
+		t.Errorf("InlineData = %x, want nil for a regular extent", fe.InlineData)
+	}
+}
+
+// writeRootBackup appends one on-disk RootBackup, identified by devRoot so
+// tests can tell copies apart after round-tripping.
+func writeRootBackup(buf *bytes.Buffer, devRoot uint64) {
+	le64(buf, 1)       // TreeRoot
+	le64(buf, 2)       // TreeRootGen
+	le64(buf, 3)       // ChunkRoot
+	le64(buf, 4)       // ChunkRootGen
+	le64(buf, 5)       // ExtentRoot
+	le64(buf, 6)       // ExtentRootGen
+	le64(buf, 7)       // FSRoot
+	le64(buf, 8)       // FSRootGen
+	le64(buf, devRoot)  // DevRoot
+	le64(buf, 10)      // DevRootGen
+	le64(buf, 11)      // CSumRoot
+	le64(buf, 12)      // CSumRootGen
+	le64(buf, 13)      // TotalBytes
+	le64(buf, 14)      // BytesUsed
+	le64(buf, 15)      // NumDevices
+	for i := 0; i < 4; i++ {
+		le64(buf, 0) // Unused
+	}
+	le8(buf, 1) // TreeRootLevel
+	le8(buf, 2) // ChunkRootLevel
+	le8(buf, 3) // ExtentRootLevel
+	le8(buf, 4) // FSRootLevel
+	le8(buf, 5) // DevRootLevel
+	le8(buf, 6) // CSumRootLevel
+	buf.Write(make([]byte, 10)) // trailing reserved pad (unused_8)
+}
+
+func TestSuperBlockParse(t *testing.T) {
+	var buf bytes.Buffer
+	buf.Write(make([]byte, CSumSize)) // CSum
+	buf.Write(make([]byte, 16))       // FSID
+	le64(&buf, 0x4000)                // ByteNr
+	le64(&buf, 0)                     // Flags
+	le64(&buf, Magic)                 // Magic
+	le64(&buf, 100)                   // Generation
+	le64(&buf, 0x1000000)             // Root
+	le64(&buf, 0x2000000)             // ChunkRoot
+	le64(&buf, 0x3000000)             // LogRoot
+	le64(&buf, 42)                    // LogRootTransid
+	le64(&buf, 1<<30)                 // TotalBytes
+	le64(&buf, 1<<20)                 // BytesUsed
+	le64(&buf, 256)                   // RootDirObjectId
+	le64(&buf, 1)                     // NumDevices
+	le32(&buf, 4096)                  // SectorSize
+	le32(&buf, 16384)                 // NodeSize
+	le32(&buf, 16384)                 // leafsize, reserved and unused since kernel 4.x
+	le32(&buf, 65536)                 // StripeSize
+	le32(&buf, 100)                   // SysChunkArraySize
+	le64(&buf, 7)                     // ChunkRootGeneration
+	le64(&buf, 0)                     // CompatFlags
+	le64(&buf, 0)                     // CompatROFlags
+	le64(&buf, 0)                     // IncompatFlags
+	le16(&buf, uint16(csum.CRC32C))   // CSumType
+	le8(&buf, 1)                      // RootLevel
+	le8(&buf, 2)                      // ChunkRootLevel
+	le8(&buf, 3)                      // LogRootLevel
+	buf.Write(make([]byte, 98))       // DevItem
+	label := make([]byte, LabelSize)
+	copy(label, "test-label")
+	buf.Write(label)
+	le64(&buf, 99)  // CacheGeneration
+	le64(&buf, 100) // UUIDTreeGeneration
+	buf.Write(make([]byte, superBlockReservedSize))
+	sysChunkArray := bytes.Repeat([]byte{0xab}, SystemChunkArraySize)
+	buf.Write(sysChunkArray)
+	for _, devRoot := range []uint64{1000, 1001, 1002, 1003} {
+		writeRootBackup(&buf, devRoot)
+	}
+
+	var got SuperBlock
+	got.Parse(NewParseBuffer(buf.Bytes()))
+
+	if got.LogRootTransid != 42 {
+		t.Errorf("LogRootTransid = %d, want 42", got.LogRootTransid)
+	}
+	if got.NodeSize != 16384 || got.StripeSize != 65536 {
+		t.Errorf("NodeSize/StripeSize = %d/%d, want 16384/65536 (leafsize field not skipped?)", got.NodeSize, got.StripeSize)
+	}
+	if got.Label != "test-label" {
+		t.Errorf("Label = %q, want %q", got.Label, "test-label")
+	}
+	if got.CacheGeneration != 99 || got.UUIDTreeGeneration != 100 {
+		t.Errorf("CacheGeneration/UUIDTreeGeneration = %d/%d, want 99/100", got.CacheGeneration, got.UUIDTreeGeneration)
+	}
+	if !bytes.Equal(got.SysChunkArray[:], sysChunkArray) {
+		t.Error("SysChunkArray was not parsed from the correct offset")
+	}
+	if !got.IsValid() {
+		t.Error("IsValid() = false, want true")
+	}
+	for i, want := range []uint64{1000, 1001, 1002, 1003} {
+		if got.RootBackups[i].DevRoot != want {
+			t.Errorf("RootBackups[%d].DevRoot = %d, want %d (trailing pad not skipped?)", i, got.RootBackups[i].DevRoot, want)
+		}
+	}
+}
+
+func TestInodeExtrefItemParse(t *testing.T) {
+	name := "a-very-long-hardlink-name"
+	var buf bytes.Buffer
+	le64(&buf, 256)                   // ParentObjectId
+	le64(&buf, 7)                     // Index
+	le16(&buf, uint16(len(name)))     // NameLen
+	buf.WriteString(name)
+
+	item := Item{Key: Key{Type: InodeExtrefKey}, Size: uint32(buf.Len())}
+	item.ParseData(NewParseBuffer(buf.Bytes()))
+
+	er, ok := item.Data.(*InodeExtrefItem)
+	if !ok {
+		t.Fatalf("Data has type %T, want *InodeExtrefItem", item.Data)
+	}
+	want := InodeExtrefItem{ParentObjectId: 256, Index: 7, NameLen: uint16(len(name)), Name: name}
+	if !reflect.DeepEqual(*er, want) {
+		t.Errorf("InodeExtrefItem.Parse = %+v, want %+v", *er, want)
+	}
+}
@@ -0,0 +1,184 @@
+/*
+ * btrfscue version 0.3
+ * Copyright (c)2011-2016 Christian Blichmann
+ *
+ * Logical -> physical address translation via the chunk tree
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+// Package chunktree resolves logical btrfs addresses (as found in
+// btrfs.Header.ByteNr, btrfs.FileExtentItem.DiskByteNr, btrfs.RootItem.ByteNr
+// and friends) to one or more physical offsets on the backing device(s).
+package chunktree // import "blichmann.eu/code/btrfscue/btrfs/chunktree"
+
+import (
+	"fmt"
+	"sort"
+
+	"blichmann.eu/code/btrfscue/btrfs"
+)
+
+// LogicalAddr is a byte offset into the filesystem's logical address space,
+// as stored on disk. It must not be confused with a PhysicalAddr.
+type LogicalAddr uint64
+
+// PhysicalAddr is a byte offset into a single backing device. It must not be
+// confused with a LogicalAddr.
+type PhysicalAddr uint64
+
+// DevOffset identifies one physical copy of a logical address: the device it
+// lives on and the byte offset into that device.
+type DevOffset struct {
+	DevId uint64
+	Addr  PhysicalAddr
+}
+
+// mapping is one entry of the chunk tree: a contiguous range of the logical
+// address space, starting at Logical and Length bytes long, and the stripes
+// that back it.
+type mapping struct {
+	Logical LogicalAddr
+	Length  uint64
+	Item    btrfs.ChunkItem
+}
+
+// Resolver translates logical addresses to physical ones using the chunk
+// tree ingested via AddChunk.
+type Resolver struct {
+	// Sorted by Logical so LogicalToPhysical can binary search.
+	chunks []mapping
+}
+
+// NewResolver returns an empty Resolver. Use AddChunk and
+// AddSystemChunkArray to populate it before calling LogicalToPhysical.
+func NewResolver() *Resolver {
+	return &Resolver{}
+}
+
+// AddChunk registers the mapping for a single ChunkItemKey item, whose
+// logical start address is the item's Key.Offset (its Key.ObjectId is always
+// btrfs.FirstChunkTreeObjectId).
+func (r *Resolver) AddChunk(logical LogicalAddr, item *btrfs.ChunkItem) {
+	i := sort.Search(len(r.chunks), func(i int) bool {
+		return r.chunks[i].Logical >= logical
+	})
+	if i < len(r.chunks) && r.chunks[i].Logical == logical {
+		r.chunks[i].Item = *item
+		r.chunks[i].Length = item.Length
+		return
+	}
+	r.chunks = append(r.chunks, mapping{})
+	copy(r.chunks[i+1:], r.chunks[i:])
+	r.chunks[i] = mapping{Logical: logical, Length: item.Length, Item: *item}
+}
+
+// AddSystemChunkArray bootstraps the resolver from the superblock's
+// sys_chunk_array, which holds the SYSTEM chunks needed to find the chunk
+// tree root itself. raw is the used part of that array, i.e. the first
+// SuperBlock.SysChunkArraySize bytes of SuperBlock.SysChunkArray; it is a
+// sequence of (disk key, ChunkItem) pairs with no surrounding Leaf/Item
+// framing. Every byte of raw is parsed, so passing the whole
+// SystemChunkArraySize-long array makes its zero padding fail with an
+// unexpected key type error.
+func (r *Resolver) AddSystemChunkArray(raw []byte) error {
+	b := btrfs.NewParseBuffer(raw)
+	for b.Unread() > 0 {
+		var k btrfs.Key
+		k.Parse(b)
+		if k.Type != btrfs.ChunkItemKey {
+			return fmt.Errorf("chunktree: unexpected key type %d in system chunk array", k.Type)
+		}
+		item := &btrfs.ChunkItem{}
+		item.Parse(b)
+		r.AddChunk(LogicalAddr(k.Offset), item)
+	}
+	return nil
+}
+
+// LogicalToPhysical translates logical into one physical offset per
+// mirror of the chunk that contains it, accounting for that chunk's
+// replication/striping profile (ChunkItem.Type).
+func (r *Resolver) LogicalToPhysical(logical LogicalAddr) ([]DevOffset, error) {
+	i := sort.Search(len(r.chunks), func(i int) bool {
+		return r.chunks[i].Logical > logical
+	}) - 1
+	if i < 0 || uint64(logical-r.chunks[i].Logical) >= r.chunks[i].Length {
+		return nil, fmt.Errorf("chunktree: no chunk covers logical address %d", logical)
+	}
+	c := &r.chunks[i]
+	chunkOffset := uint64(logical - c.Logical)
+
+	switch {
+	case c.Item.Type&(btrfs.BlockGroupRAID5|btrfs.BlockGroupRAID6) != 0:
+		return nil, fmt.Errorf("chunktree: RAID5/RAID6 parity striping is not supported (chunk type %#x)", c.Item.Type)
+	case c.Item.Type&btrfs.BlockGroupRAID10 != 0:
+		return raid10Offset(c, chunkOffset)
+	case c.Item.Type&btrfs.BlockGroupRAID0 != 0:
+		return raid0Offset(c, chunkOffset)
+	default:
+		// SINGLE, DUP, RAID1 and friends: every stripe holds a full,
+		// unstriped mirror of the chunk, so the same chunk-relative offset
+		// applies to all of them.
+		offsets := make([]DevOffset, len(c.Item.Stripes))
+		for j, s := range c.Item.Stripes {
+			offsets[j] = DevOffset{DevId: s.DevId, Addr: PhysicalAddr(s.Offset + chunkOffset)}
+		}
+		return offsets, nil
+	}
+}
+
+// raid0Offset resolves chunkOffset for a RAID0 chunk, where data is
+// interleaved in Item.StripeLen-sized units across all of Item.Stripes with
+// no redundancy, so exactly one physical offset is returned.
+func raid0Offset(c *mapping, chunkOffset uint64) ([]DevOffset, error) {
+	numStripes := uint64(len(c.Item.Stripes))
+	if numStripes == 0 || c.Item.StripeLen == 0 {
+		return nil, fmt.Errorf("chunktree: RAID0 chunk has no stripes or zero stripe length")
+	}
+	stripeNr := chunkOffset / c.Item.StripeLen
+	stripeIndex := stripeNr % numStripes
+	stripeOffset := (stripeNr/numStripes)*c.Item.StripeLen + chunkOffset%c.Item.StripeLen
+	s := c.Item.Stripes[stripeIndex]
+	return []DevOffset{{DevId: s.DevId, Addr: PhysicalAddr(s.Offset + stripeOffset)}}, nil
+}
+
+// raid10Offset resolves chunkOffset for a RAID10 chunk: Item.Stripes is
+// divided into groups of Item.SubStripes mirrors each, and the groups are
+// striped like RAID0. It returns one physical offset per mirror in the
+// group that holds chunkOffset.
+func raid10Offset(c *mapping, chunkOffset uint64) ([]DevOffset, error) {
+	subStripes := uint64(c.Item.SubStripes)
+	numStripes := uint64(len(c.Item.Stripes))
+	if subStripes == 0 || numStripes == 0 || numStripes%subStripes != 0 || c.Item.StripeLen == 0 {
+		return nil, fmt.Errorf("chunktree: malformed RAID10 chunk (stripes=%d, substripes=%d)", numStripes, subStripes)
+	}
+	numGroups := numStripes / subStripes
+	stripeNr := chunkOffset / c.Item.StripeLen
+	groupIndex := stripeNr % numGroups
+	stripeOffset := (stripeNr/numGroups)*c.Item.StripeLen + chunkOffset%c.Item.StripeLen
+	offsets := make([]DevOffset, subStripes)
+	for j := uint64(0); j < subStripes; j++ {
+		s := c.Item.Stripes[groupIndex*subStripes+j]
+		offsets[j] = DevOffset{DevId: s.DevId, Addr: PhysicalAddr(s.Offset + stripeOffset)}
+	}
+	return offsets, nil
+}
@@ -0,0 +1,113 @@
+/*
+ * btrfscue version 0.3
+ * Copyright (c)2011-2016 Christian Blichmann
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package chunktree
+
+import (
+	"testing"
+
+	"blichmann.eu/code/btrfscue/btrfs"
+)
+
+func chunk(typ uint64, stripeLen uint64, subStripes uint16, stripes ...btrfs.Stripe) *btrfs.ChunkItem {
+	return &btrfs.ChunkItem{
+		Length:     1 << 24,
+		Type:       typ,
+		StripeLen:  stripeLen,
+		NumStripes: uint16(len(stripes)),
+		SubStripes: subStripes,
+		Stripes:    stripes,
+	}
+}
+
+func TestLogicalToPhysicalSingle(t *testing.T) {
+	r := NewResolver()
+	r.AddChunk(0, chunk(btrfs.BlockGroupData, 65536, 1,
+		btrfs.Stripe{DevId: 1, Offset: 0x10000}))
+
+	got, err := r.LogicalToPhysical(0x1234)
+	if err != nil {
+		t.Fatalf("LogicalToPhysical: %v", err)
+	}
+	want := []DevOffset{{DevId: 1, Addr: PhysicalAddr(0x10000 + 0x1234)}}
+	if len(got) != 1 || got[0] != want[0] {
+		t.Errorf("LogicalToPhysical = %+v, want %+v", got, want)
+	}
+}
+
+func TestLogicalToPhysicalRAID0(t *testing.T) {
+	const stripeLen = 64 * 1024
+	r := NewResolver()
+	r.AddChunk(0, chunk(btrfs.BlockGroupData|btrfs.BlockGroupRAID0, stripeLen, 0,
+		btrfs.Stripe{DevId: 1, Offset: 0},
+		btrfs.Stripe{DevId: 2, Offset: 0}))
+
+	// Second stripe unit (stripeLen..2*stripeLen) belongs to device 2, at
+	// physical offset 0 within that device's share of the chunk.
+	got, err := r.LogicalToPhysical(LogicalAddr(stripeLen + 10))
+	if err != nil {
+		t.Fatalf("LogicalToPhysical: %v", err)
+	}
+	if len(got) != 1 || got[0].DevId != 2 || got[0].Addr != PhysicalAddr(10) {
+		t.Errorf("LogicalToPhysical = %+v, want one offset on dev 2 at 10", got)
+	}
+}
+
+func TestLogicalToPhysicalRAID10(t *testing.T) {
+	const stripeLen = 64 * 1024
+	r := NewResolver()
+	r.AddChunk(0, chunk(btrfs.BlockGroupData|btrfs.BlockGroupRAID10, stripeLen, 2,
+		btrfs.Stripe{DevId: 1, Offset: 0},
+		btrfs.Stripe{DevId: 2, Offset: 0},
+		btrfs.Stripe{DevId: 3, Offset: 0},
+		btrfs.Stripe{DevId: 4, Offset: 0}))
+
+	got, err := r.LogicalToPhysical(LogicalAddr(stripeLen + 10))
+	if err != nil {
+		t.Fatalf("LogicalToPhysical: %v", err)
+	}
+	if len(got) != 2 || got[0].DevId != 3 || got[1].DevId != 4 {
+		t.Errorf("LogicalToPhysical = %+v, want mirrors on devs 3 and 4", got)
+	}
+}
+
+func TestLogicalToPhysicalRAID5Unsupported(t *testing.T) {
+	r := NewResolver()
+	r.AddChunk(0, chunk(btrfs.BlockGroupData|btrfs.BlockGroupRAID5, 65536, 0,
+		btrfs.Stripe{DevId: 1, Offset: 0},
+		btrfs.Stripe{DevId: 2, Offset: 0},
+		btrfs.Stripe{DevId: 3, Offset: 0}))
+
+	if _, err := r.LogicalToPhysical(10); err == nil {
+		t.Fatal("LogicalToPhysical on a RAID5 chunk: got nil error, want an error")
+	}
+}
+
+func TestLogicalToPhysicalNoChunk(t *testing.T) {
+	r := NewResolver()
+	if _, err := r.LogicalToPhysical(123); err == nil {
+		t.Fatal("LogicalToPhysical on an empty resolver: got nil error, want an error")
+	}
+}
@@ -0,0 +1,161 @@
+/*
+ * btrfscue version 0.3
+ * Copyright (c)2011-2016 Christian Blichmann
+ *
+ * Checksum algorithms used on btrfs metadata and data blocks
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+// Package csum implements the checksum algorithms a btrfs filesystem may be
+// formatted with, negotiated via the superblock's csum_type field.
+package csum // import "blichmann.eu/code/btrfscue/btrfs/csum"
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+
+	"github.com/cespare/xxhash/v2"
+	"golang.org/x/crypto/blake2b"
+)
+
+// Algo identifies one of the checksum algorithms a btrfs filesystem may be
+// formatted with. Values match the on-disk csum_type field of the
+// superblock.
+type Algo uint16
+
+const (
+	CRC32C Algo = iota
+	XXHash64
+	SHA256
+	Blake2b256
+)
+
+// Size returns the length in bytes of a checksum produced by a, or 0 if a is
+// not a known algorithm.
+func (a Algo) Size() int {
+	switch a {
+	case CRC32C:
+		return 4
+	case XXHash64:
+		return 8
+	case SHA256:
+		return 32
+	case Blake2b256:
+		return 32
+	}
+	return 0
+}
+
+func (a Algo) String() string {
+	switch a {
+	case CRC32C:
+		return "crc32c"
+	case XXHash64:
+		return "xxhash64"
+	case SHA256:
+		return "sha256"
+	case Blake2b256:
+		return "blake2b256"
+	}
+	return fmt.Sprintf("Algo(%d)", uint16(a))
+}
+
+// Verifier computes and checks the checksum of a raw metadata or data block.
+type Verifier interface {
+	// Sum returns the checksum of data.
+	Sum(data []byte) []byte
+	// Verify reports whether want starts with the checksum of data.
+	Verify(data, want []byte) bool
+}
+
+// New returns the Verifier for algo, or an error if algo is not a supported
+// on-disk checksum algorithm.
+func New(algo Algo) (Verifier, error) {
+	switch algo {
+	case CRC32C:
+		return crc32cVerifier{}, nil
+	case XXHash64:
+		return xxHash64Verifier{}, nil
+	case SHA256:
+		return sha256Verifier{}, nil
+	case Blake2b256:
+		return blake2b256Verifier{}, nil
+	}
+	return nil, fmt.Errorf("csum: unsupported algorithm %s", algo)
+}
+
+// verify reports whether want starts with sum, the checksum computed by one
+// of the Verifier implementations below.
+func verify(sum, want []byte) bool {
+	return len(want) >= len(sum) && bytes.Equal(sum, want[:len(sum)])
+}
+
+var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+type crc32cVerifier struct{}
+
+func (crc32cVerifier) Sum(data []byte) []byte {
+	var buf [4]byte
+	binary.LittleEndian.PutUint32(buf[:], crc32.Checksum(data, castagnoliTable))
+	return buf[:]
+}
+
+func (v crc32cVerifier) Verify(data, want []byte) bool {
+	return verify(v.Sum(data), want)
+}
+
+type xxHash64Verifier struct{}
+
+func (xxHash64Verifier) Sum(data []byte) []byte {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], xxhash.Sum64(data))
+	return buf[:]
+}
+
+func (v xxHash64Verifier) Verify(data, want []byte) bool {
+	return verify(v.Sum(data), want)
+}
+
+type sha256Verifier struct{}
+
+func (sha256Verifier) Sum(data []byte) []byte {
+	sum := sha256.Sum256(data)
+	return sum[:]
+}
+
+func (v sha256Verifier) Verify(data, want []byte) bool {
+	return verify(v.Sum(data), want)
+}
+
+type blake2b256Verifier struct{}
+
+func (blake2b256Verifier) Sum(data []byte) []byte {
+	sum := blake2b.Sum256(data)
+	return sum[:]
+}
+
+func (v blake2b256Verifier) Verify(data, want []byte) bool {
+	return verify(v.Sum(data), want)
+}
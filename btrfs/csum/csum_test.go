@@ -0,0 +1,62 @@
+/*
+ * btrfscue version 0.3
+ * Copyright (c)2011-2016 Christian Blichmann
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package csum
+
+import "testing"
+
+func TestVerifiersRoundTrip(t *testing.T) {
+	data := []byte("the quick brown fox jumps over the lazy dog")
+
+	for _, algo := range []Algo{CRC32C, XXHash64, SHA256, Blake2b256} {
+		t.Run(algo.String(), func(t *testing.T) {
+			v, err := New(algo)
+			if err != nil {
+				t.Fatalf("New(%s): %v", algo, err)
+			}
+			sum := v.Sum(data)
+			if len(sum) != algo.Size() {
+				t.Errorf("len(Sum(data)) = %d, want %d", len(sum), algo.Size())
+			}
+			if !v.Verify(data, sum) {
+				t.Error("Verify(data, Sum(data)) = false, want true")
+			}
+			if v.Verify(data, append([]byte(nil), sum[:len(sum)-1]...)) {
+				t.Error("Verify with a truncated checksum = true, want false")
+			}
+			corrupted := append([]byte(nil), data...)
+			corrupted[0] ^= 0xff
+			if v.Verify(corrupted, sum) {
+				t.Error("Verify(corruptedData, Sum(data)) = true, want false")
+			}
+		})
+	}
+}
+
+func TestNewUnsupportedAlgo(t *testing.T) {
+	if _, err := New(Algo(99)); err == nil {
+		t.Fatal("New(Algo(99)): got nil error, want an error")
+	}
+}
@@ -0,0 +1,112 @@
+/*
+ * btrfscue version 0.3
+ * Copyright (c)2011-2016 Christian Blichmann
+ *
+ * Free space tree decoding
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+// Package freespace reconstructs a block group's free space layout from its
+// free space tree items (FreeSpaceInfoKey, FreeSpaceExtentKey and
+// FreeSpaceBitmapKey).
+package freespace // import "blichmann.eu/code/btrfscue/btrfs/freespace"
+
+import (
+	"fmt"
+	"sort"
+
+	"blichmann.eu/code/btrfscue/btrfs"
+)
+
+// Range is one contiguous run of free space, starting at Offset and Length
+// bytes long.
+type Range struct {
+	Offset uint64
+	Length uint64
+}
+
+// Walk reconstructs the free space ranges of a single block group from
+// items, the set of free space tree items belonging to that block group
+// (its FreeSpaceInfoKey item plus either its FreeSpaceExtentKey or
+// FreeSpaceBitmapKey items). sectorSize is the filesystem's sector size, as
+// found on the superblock, and is only used to interpret bitmap items.
+func Walk(sectorSize uint64, items []btrfs.Item) ([]Range, error) {
+	info := findInfo(items)
+	if info == nil {
+		return nil, fmt.Errorf("freespace: block group has no FreeSpaceInfo item")
+	}
+	if info.Flags&btrfs.FreeSpaceUsingBitmaps != 0 {
+		return walkBitmaps(sectorSize, items), nil
+	}
+	return walkExtents(items), nil
+}
+
+func findInfo(items []btrfs.Item) *btrfs.FreeSpaceInfo {
+	for i := range items {
+		if info, ok := items[i].Data.(*btrfs.FreeSpaceInfo); ok {
+			return info
+		}
+	}
+	return nil
+}
+
+func walkExtents(items []btrfs.Item) []Range {
+	var ranges []Range
+	for i := range items {
+		if items[i].Type != btrfs.FreeSpaceExtentKey {
+			continue
+		}
+		ranges = append(ranges, Range{
+			Offset: items[i].Key.ObjectId,
+			Length: items[i].Key.Offset,
+		})
+	}
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].Offset < ranges[j].Offset })
+	return ranges
+}
+
+func walkBitmaps(sectorSize uint64, items []btrfs.Item) []Range {
+	var ranges []Range
+	for i := range items {
+		if items[i].Type != btrfs.FreeSpaceBitmapKey {
+			continue
+		}
+		bitmap, ok := items[i].Data.(*btrfs.FreeSpaceBitmap)
+		if !ok {
+			continue
+		}
+		start := items[i].Key.ObjectId
+		for bit := 0; bit < len(bitmap.Bits)*8; bit++ {
+			if bitmap.Bits[bit/8]&(1<<uint(bit%8)) == 0 {
+				continue
+			}
+			sector := start + uint64(bit)*sectorSize
+			if n := len(ranges); n > 0 && ranges[n-1].Offset+ranges[n-1].Length == sector {
+				ranges[n-1].Length += sectorSize
+			} else {
+				ranges = append(ranges, Range{Offset: sector, Length: sectorSize})
+			}
+		}
+	}
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].Offset < ranges[j].Offset })
+	return ranges
+}
@@ -0,0 +1,80 @@
+/*
+ * btrfscue version 0.3
+ * Copyright (c)2011-2016 Christian Blichmann
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ * LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ * CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ * SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ * INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ * CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package freespace
+
+import (
+	"reflect"
+	"testing"
+
+	"blichmann.eu/code/btrfscue/btrfs"
+)
+
+func TestWalkExtents(t *testing.T) {
+	items := []btrfs.Item{
+		{Key: btrfs.Key{Type: btrfs.FreeSpaceInfoKey}, Data: &btrfs.FreeSpaceInfo{}},
+		{Key: btrfs.Key{Type: btrfs.FreeSpaceExtentKey, ObjectId: 0x20000, Offset: 0x1000}},
+		{Key: btrfs.Key{Type: btrfs.FreeSpaceExtentKey, ObjectId: 0x10000, Offset: 0x2000}},
+	}
+
+	got, err := Walk(4096, items)
+	if err != nil {
+		t.Fatalf("Walk: %v", err)
+	}
+	want := []Range{
+		{Offset: 0x10000, Length: 0x2000},
+		{Offset: 0x20000, Length: 0x1000},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Walk() = %+v, want %+v", got, want)
+	}
+}
+
+func TestWalkBitmapsCoalescesAdjacentSectors(t *testing.T) {
+	items := []btrfs.Item{
+		{Key: btrfs.Key{Type: btrfs.FreeSpaceInfoKey},
+			Data: &btrfs.FreeSpaceInfo{Flags: btrfs.FreeSpaceUsingBitmaps}},
+		{Key: btrfs.Key{Type: btrfs.FreeSpaceBitmapKey, ObjectId: 0x10000},
+			Data: &btrfs.FreeSpaceBitmap{Bits: []byte{0x03, 0x04}}},
+	}
+
+	got, err := Walk(4096, items)
+	if err != nil {
+		t.Fatalf("Walk: %v", err)
+	}
+	want := []Range{
+		{Offset: 0x10000, Length: 2 * 4096},
+		{Offset: 0x10000 + 10*4096, Length: 4096},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Walk() = %+v, want %+v", got, want)
+	}
+}
+
+func TestWalkNoFreeSpaceInfo(t *testing.T) {
+	if _, err := Walk(4096, nil); err == nil {
+		t.Fatal("Walk with no FreeSpaceInfo item: got nil error, want an error")
+	}
+}